@@ -8,9 +8,13 @@ import (
 	"math"
 	"math/cmplx"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/scanner"
 )
 
@@ -18,15 +22,19 @@ const help = `
 Generates the graph of the complex function 1/(1 + 𝑧²), and writes an svg file to std out`
 
 var (
-	flagHelp    = flag.Bool("help", false, "print usage and help, and exit")
-	flagAddress = flag.String("a", "", "address on which to listen")
-	flagWidth = flag.Int("w", 600, "width")
-	flagHeight = flag.Int("h", 320, "height")
-	flagXYRange = flag.Float64("r", 30.0, "range for x, y")
-	flagCells = flag.Int("c", 100, "number of cells")
+	flagHelp        = flag.Bool("help", false, "print usage and help, and exit")
+	flagAddress     = flag.String("a", "", "address on which to listen")
+	flagWidth       = flag.Int("w", 600, "width")
+	flagHeight      = flag.Int("h", 320, "height")
+	flagXYRange     = flag.Float64("r", 30.0, "range for x, y")
+	flagCells       = flag.Int("c", 100, "number of cells")
 	flagScaleFactor = flag.Float64("s", 0.4, "scale factor")
-	flagAngle = flag.Float64("angle", 1.0/12.0, "fraction of a circle to rotate by")
-	flagEval = flag.String("expr", "1/(1+(z*z))", "expression to be evaluated")
+	flagAngle       = flag.Float64("angle", 1.0/12.0, "fraction of a circle to rotate by")
+	flagEval        = flag.String("expr", "1/(1+(z*z))", "expression to be evaluated")
+	flagMode        = flag.String("mode", "surface", "rendering mode: surface (3D wireframe) or domain (domain coloring)")
+	flagWorkers     = flag.Int("j", runtime.NumCPU(), "max number of worker goroutines for grid computation")
+	flagElev        = flag.Float64("elev", 30.0, "camera elevation in degrees, for sphere mode")
+	flagAzim        = flag.Float64("azim", 30.0, "camera azimuth in degrees, for sphere mode")
 )
 
 func usage() {
@@ -41,13 +49,16 @@ func usage() {
 
 var defaultParam params
 
-type params struct{
-	width, height, cells int
+type params struct {
+	width, height, cells                         int
 	xyrange, xyscale, zscale, scaleFactor, angle float64
-	expression string
+	expression                                   string
+	mode                                         string
+	workers                                      int
+	elev, azim                                   float64 // radians, camera orientation for sphere mode
 }
 
-func main(){
+func main() {
 	log.SetPrefix("px: ")
 	log.SetFlags(0)
 
@@ -67,13 +78,17 @@ func main(){
 	defaultParam.height = *flagHeight
 	defaultParam.cells = *flagCells
 	defaultParam.xyrange = *flagXYRange
-	defaultParam.xyscale= float64(defaultParam.width)/2.0/defaultParam.xyrange
-	defaultParam.scaleFactor=*flagScaleFactor
+	defaultParam.xyscale = float64(defaultParam.width) / 2.0 / defaultParam.xyrange
+	defaultParam.scaleFactor = *flagScaleFactor
 	defaultParam.zscale = float64(defaultParam.height) * defaultParam.scaleFactor
-	defaultParam.angle = 2* math.Pi * *flagAngle
+	defaultParam.angle = 2 * math.Pi * *flagAngle
 	defaultParam.expression = *flagEval
+	defaultParam.mode = *flagMode
+	defaultParam.workers = *flagWorkers
+	defaultParam.elev = *flagElev * math.Pi / 180
+	defaultParam.azim = *flagAzim * math.Pi / 180
 	expr, err := parseAndCheck(defaultParam.expression)
-	if err != nil{
+	if err != nil {
 		fmt.Println("error, bad expression")
 		return
 	}
@@ -81,88 +96,577 @@ func main(){
 	//      {600 320 100 30 10 0 0 0.5235987755982988 1/(1+(z*z))}
 	if *flagAddress == "" {
 		fmt.Println(defaultParam)
-		writesvg(os.Stdout, &defaultParam, func(z complex128)complex128{return expr.Eval(Env{"z":z})})
+		render(os.Stdout, &defaultParam, Compile(expr))
 		return
 	}
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/animate", animateHandler)
 	log.Fatal(http.ListenAndServe(*flagAddress, nil))
 }
 
-func handler(w http.ResponseWriter, r *http.Request){
-	params := defaultParam
-	q := r.URL.Query()
-	width, err := strconv.Atoi(q.Get("width"))
-	if err == nil && width > 0 {
-		params.width = width
+// maxQueryWorkers caps the workers= query parameter so a single unauthenticated
+// request can't make computeGrid spawn an unbounded number of goroutines.
+// The -j flag isn't capped: it's set by whoever runs the binary, not by
+// request input.
+const maxQueryWorkers = 64
+
+// paramsFromQuery overlays query parameters onto base, leaving any field
+// unset or invalid in the query untouched. Shared by handler and
+// animateHandler so the two endpoints accept the same flag-mirroring
+// parameters.
+func paramsFromQuery(base params, q url.Values) params {
+	p := base
+	if width, err := strconv.Atoi(q.Get("width")); err == nil && width > 0 {
+		p.width = width
+	}
+	if height, err := strconv.Atoi(q.Get("height")); err == nil && height > 0 {
+		p.height = height
+	}
+	if cells, err := strconv.Atoi(q.Get("cells")); err == nil && cells > 0 {
+		p.cells = cells
+	}
+	if scaleFactor, err := strconv.ParseFloat(q.Get("scalefactor"), 64); err == nil && scaleFactor > 0 {
+		p.scaleFactor = scaleFactor
+	}
+	if angle, err := strconv.ParseFloat(q.Get("angle"), 64); err == nil && angle > 0 {
+		p.angle = angle
 	}
-	height, err := strconv.Atoi(q.Get("height"))
-	if err == nil && height > 0 {
-		params.height = height
+	if expression := q.Get("expr"); expression != "" {
+		p.expression = expression
 	}
-	cells, err := strconv.Atoi(q.Get("cells"))
-	if err == nil && cells > 0 {
-		params.cells = cells
+	if mode := q.Get("mode"); mode != "" {
+		p.mode = mode
 	}
-	scaleFactor, err := strconv.ParseFloat(q.Get("scalefactor"), 64)
-	if err == nil && scaleFactor > 0 {
-		params.scaleFactor = scaleFactor
+	if workers, err := strconv.Atoi(q.Get("workers")); err == nil && workers > 0 {
+		if workers > maxQueryWorkers {
+			workers = maxQueryWorkers
+		}
+		p.workers = workers
 	}
-	angle, err := strconv.ParseFloat(q.Get("angle"), 64)
-	if err == nil && angle > 0 {
-		params.angle = angle
+	if elev, err := strconv.ParseFloat(q.Get("elev"), 64); err == nil {
+		p.elev = elev * math.Pi / 180
 	}
-	expression := q.Get("expr")
-	if expression != "" {
-		params.expression = expression
+	if azim, err := strconv.ParseFloat(q.Get("azim"), 64); err == nil {
+		p.azim = azim * math.Pi / 180
 	}
+	return p
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	params := paramsFromQuery(defaultParam, r.URL.Query())
 	expr, err := parseAndCheck(params.expression)
-	if err != nil{
+	if err != nil {
 		fmt.Fprintln(w, "error, bad expression")
 		return
 	}
-	params.xyscale= float64(params.width)/2.0/params.xyrange
+	params.xyscale = float64(params.width) / 2.0 / params.xyrange
 	params.zscale = float64(params.height) * params.scaleFactor
 	w.Header().Set("Content-Type", "image/svg+xml")
 	fmt.Println(params)
-	writesvg(w, &params, func(z complex128)complex128{return expr.Eval(Env{"z":z})})
+	render(w, &params, Compile(expr))
+}
+
+// animateHandler serves /animate: expr may reference both z and the
+// animation variable t. It renders frames samples of t evenly spaced over
+// [tmin,tmax] and returns a single SVG whose polygons animate between the
+// per-frame shapes using <animate>.
+func animateHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	params := paramsFromQuery(defaultParam, q)
+	expr, err := parseAndCheck(params.expression)
+	if err != nil {
+		fmt.Fprintln(w, "error, bad expression")
+		return
+	}
+	tmin, err := strconv.ParseFloat(q.Get("tmin"), 64)
+	if err != nil {
+		tmin = 0
+	}
+	tmax, err := strconv.ParseFloat(q.Get("tmax"), 64)
+	if err != nil {
+		tmax = 1
+	}
+	frames, err := strconv.Atoi(q.Get("frames"))
+	if err != nil || frames < 1 {
+		frames = 30
+	}
+	fps, err := strconv.ParseFloat(q.Get("fps"), 64)
+	if err != nil || fps <= 0 {
+		fps = 12
+	}
+	params.xyscale = float64(params.width) / 2.0 / params.xyrange
+	params.zscale = float64(params.height) * params.scaleFactor
+	w.Header().Set("Content-Type", "image/svg+xml")
+	fmt.Println(params, tmin, tmax, frames, fps)
+	renderAnimated(w, &params, expr, tmin, tmax, frames, fps)
+}
+
+// frameTimes returns the frames values of t evenly spaced over [tmin,tmax]
+// that /animate samples: t = tmin + k*(tmax-tmin)/(frames-1) for frame k,
+// or just tmin when there's only one frame.
+func frameTimes(tmin, tmax float64, frames int) []complex128 {
+	ts := make([]complex128, frames)
+	for k := range ts {
+		if frames == 1 {
+			ts[k] = complex(tmin, 0)
+			continue
+		}
+		ts[k] = complex(tmin+float64(k)*(tmax-tmin)/float64(frames-1), 0)
+	}
+	return ts
+}
+
+// renderAnimated dispatches to the animated form of the rendering mode
+// selected by p.mode, mirroring render's dispatch for single-frame output.
+func renderAnimated(w io.Writer, p *params, expr Expr, tmin, tmax float64, frames int, fps float64) {
+	switch p.mode {
+	case "domain":
+		writeAnimatedDomainColoring(w, p, expr, tmin, tmax, frames, fps)
+	case "sphere":
+		writeAnimatedSphere(w, p, expr, tmin, tmax, frames, fps)
+	default:
+		writeAnimatedSurface(w, p, expr, tmin, tmax, frames, fps)
+	}
+}
+
+// writeAnimatedSurface renders frames samples of expr(z,t) for t evenly
+// spaced over [tmin,tmax], reusing computeGrid for each frame's wireframe,
+// and emits a single SVG where each cell's <polygon> cycles through its
+// per-frame points via a nested <animate> element.
+func writeAnimatedSurface(w io.Writer, p *params, expr Expr, tmin, tmax float64, frames int, fps float64) {
+	fmt.Fprintf(w, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"style='stroke: grey; fill:white ; stroke-width: 0.7' "+
+		"width='%d' height='%d'>", p.width, p.height)
+
+	base := Compile(expr)
+	ts := frameTimes(tmin, tmax, frames)
+	grids := make([][][][2]float64, frames)
+	for k, t := range ts {
+		grids[k] = computeGrid(base.WithT(t), p)
+	}
+
+	dur := float64(frames) / fps
+	for i := 0; i < p.cells; i++ {
+		for j := 0; j < p.cells; j++ {
+			values := make([]string, frames)
+			for k, grid := range grids {
+				a, b, c, d := grid[i+1][j], grid[i][j], grid[i][j+1], grid[i+1][j+1]
+				values[k] = fmt.Sprintf("%g,%g %g,%g %g,%g %g,%g",
+					a[0], a[1], b[0], b[1], c[0], c[1], d[0], d[1])
+			}
+			fmt.Fprintf(w, "<polygon points='%s'>", values[0])
+			fmt.Fprintf(w, "<animate attributeName='points' values='%s' dur='%gs' repeatCount='indefinite'/>",
+				strings.Join(values, ";"), dur)
+			fmt.Fprintln(w, "</polygon>")
+		}
+	}
+	fmt.Fprintln(w, "</svg>")
 }
 
-func corner(f func(complex128)complex128,i, j int, p *params)(float64, float64){
-	x := p.xyrange * (float64(i)/float64(p.cells)-0.5)
+// writeAnimatedDomainColoring animates domain coloring over t: each cell's
+// (x,y) position is fixed, so only its fill color depends on the frame,
+// cycled via a nested <animate attributeName='fill'>.
+func writeAnimatedDomainColoring(w io.Writer, p *params, expr Expr, tmin, tmax float64, frames int, fps float64) {
+	fmt.Fprintf(w, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"width='%d' height='%d' shape-rendering='crispEdges'>", p.width, p.height)
+
+	base := Compile(expr)
+	ts := frameTimes(tmin, tmax, frames)
+	progs := make([]*Program, frames)
+	for k, t := range ts {
+		progs[k] = base.WithT(t)
+	}
+
+	cw := float64(p.width) / float64(p.cells)
+	ch := float64(p.height) / float64(p.cells)
+	dur := float64(frames) / fps
+	for i := 0; i < p.cells; i++ {
+		x := p.xyrange * (2*float64(i)/float64(p.cells) - 1)
+		for j := 0; j < p.cells; j++ {
+			y := p.xyrange * (2*float64(j)/float64(p.cells) - 1)
+
+			values := make([]string, frames)
+			for k, prog := range progs {
+				fz := prog.Eval(complex(x, y))
+				r, g, b := domainColor(fz)
+				values[k] = fmt.Sprintf("rgb(%d,%d,%d)", r, g, b)
+			}
+
+			px := float64(i) * cw
+			py := float64(p.height) - float64(j+1)*ch
+			fmt.Fprintf(w, "<rect x='%g' y='%g' width='%g' height='%g' fill='%s' stroke='none'>",
+				px, py, cw, ch, values[0])
+			fmt.Fprintf(w, "<animate attributeName='fill' values='%s' dur='%gs' repeatCount='indefinite'/>",
+				strings.Join(values, ";"), dur)
+			fmt.Fprintln(w, "</rect>")
+		}
+	}
+	fmt.Fprintln(w, "</svg>")
+}
+
+// writeAnimatedSphere animates the Riemann-sphere mode over t. The
+// stereographic geometry and camera rotation depend only on z and the
+// -elev/-azim flags, not t, so each cell's screen position and its
+// painter's-algorithm depth (meanZ) are computed once; only its fill color
+// is resampled per frame and cycled via <animate attributeName='fill'>.
+func writeAnimatedSphere(w io.Writer, p *params, expr Expr, tmin, tmax float64, frames int, fps float64) {
+	fmt.Fprintf(w, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"width='%d' height='%d'>", p.width, p.height)
+
+	base := Compile(expr)
+	ts := frameTimes(tmin, tmax, frames)
+	progs := make([]*Program, frames)
+	for k, t := range ts {
+		progs[k] = base.WithT(t)
+	}
+
+	type animQuad struct {
+		corners [4][2]float64
+		meanZ   float64
+		cx, cy  float64
+	}
+	quads := make([]animQuad, 0, p.cells*p.cells)
+	sphereCorner := func(i, j int) (X, Y, Z float64) {
+		x := p.xyrange * (2*float64(i)/float64(p.cells) - 1)
+		y := p.xyrange * (2*float64(j)/float64(p.cells) - 1)
+		X, Y, Z = stereographic(x, y)
+		return rotate(X, Y, Z, p.elev, p.azim)
+	}
+	for i := 0; i < p.cells; i++ {
+		cx := p.xyrange * (2*(float64(i)+0.5)/float64(p.cells) - 1)
+		for j := 0; j < p.cells; j++ {
+			cy := p.xyrange * (2*(float64(j)+0.5)/float64(p.cells) - 1)
+
+			var q animQuad
+			q.cx, q.cy = cx, cy
+			for k, ij := range [4][2]int{{i, j}, {i + 1, j}, {i + 1, j + 1}, {i, j + 1}} {
+				X, Y, Z := sphereCorner(ij[0], ij[1])
+				sx, sy := project(X, Y, Z, p)
+				q.corners[k] = [2]float64{sx, sy}
+				q.meanZ += Z
+			}
+			q.meanZ /= 4
+			quads = append(quads, q)
+		}
+	}
+	sort.Slice(quads, func(a, b int) bool { return quads[a].meanZ < quads[b].meanZ })
+
+	dur := float64(frames) / fps
+	for _, q := range quads {
+		values := make([]string, frames)
+		for k, prog := range progs {
+			fz := prog.Eval(complex(q.cx, q.cy))
+			r, g, b := sphereColor(fz)
+			values[k] = fmt.Sprintf("rgb(%d,%d,%d)", r, g, b)
+		}
+		fmt.Fprintf(w, "<polygon points='%g,%g %g,%g %g,%g %g,%g' fill='%s' stroke='none'>",
+			q.corners[0][0], q.corners[0][1], q.corners[1][0], q.corners[1][1],
+			q.corners[2][0], q.corners[2][1], q.corners[3][0], q.corners[3][1], values[0])
+		fmt.Fprintf(w, "<animate attributeName='fill' values='%s' dur='%gs' repeatCount='indefinite'/>",
+			strings.Join(values, ";"), dur)
+		fmt.Fprintln(w, "</polygon>")
+	}
+	fmt.Fprintln(w, "</svg>")
+}
+
+// render dispatches to the rendering mode selected by p.mode, defaulting to
+// the 3D wireframe surface when the mode is unrecognised.
+func render(w io.Writer, p *params, prog *Program) {
+	switch p.mode {
+	case "domain":
+		writeDomainColoring(w, p, prog)
+	case "sphere":
+		writeSphere(w, p, prog)
+	default:
+		writesvg(w, p, prog)
+	}
+}
+
+func corner(prog *Program, i, j int, p *params) (float64, float64) {
+	x := p.xyrange * (float64(i)/float64(p.cells) - 0.5)
 	y := p.xyrange * (float64(j)/float64(p.cells) - 0.5)
-	cnum := complex(x,y)
-	n := f(cnum)
-	//n:= f(cnum)
+	cnum := complex(x, y)
+	n := prog.Eval(cnum)
 	z := cmplx.Abs(n)
 
-	sx := float64(p.width)/2+(x-y)*math.Cos(p.angle)*p.xyscale
-	sy:=float64(p.height)/2+(x+y)*math.Sin(p.angle)*p.xyscale -z*p.zscale
+	sx := float64(p.width)/2 + (x-y)*math.Cos(p.angle)*p.xyscale
+	sy := float64(p.height)/2 + (x+y)*math.Sin(p.angle)*p.xyscale - z*p.zscale
 	return sx, sy
 }
 
-func f(cnum complex128) complex128{
-	z := 1/(1+(cnum*cnum))
+func f(cnum complex128) complex128 {
+	z := 1 / (1 + (cnum * cnum))
 	return z
 }
 
-func writesvg(w io.Writer, p *params, f func(z complex128) complex128){
+func writesvg(w io.Writer, p *params, prog *Program) {
 	fmt.Fprintf(w, "<svg xmlns='http://www.w3.org/2000/svg' "+
 		"style='stroke: grey; fill:white ; stroke-width: 0.7' "+
 		"width='%d' height='%d'>", p.width, p.height)
-	for i := 0; i< p.cells;i++{
-		for j := 0; j< p.cells;j++{
-			ax, ay := corner(f,i+1, j, p)
-			bx, by := corner(f,i,j, p)
-			cx,cy := corner(f,i,j+1, p)
-			dx, dy := corner(f,i+1,j+1, p)
+	grid := computeGrid(prog, p)
+	for i := 0; i < p.cells; i++ {
+		for j := 0; j < p.cells; j++ {
+			a := grid[i+1][j]
+			b := grid[i][j]
+			c := grid[i][j+1]
+			d := grid[i+1][j+1]
 			fmt.Fprintf(w, "<polygon points ='%g,%g %g,%g %g,%g %g,%g'/>\n",
-				ax, ay, bx ,by ,cx,cy,dx,dy)
+				a[0], a[1], b[0], b[1], c[0], c[1], d[0], d[1])
 		}
 	}
 	fmt.Fprintln(w, "</svg>")
 }
 
-type Expr interface{
+// computeGrid fills a (cells+1)x(cells+1) grid of projected corner
+// coordinates in parallel: numWorkers(p) goroutines each claim rows from a
+// shared channel, evaluate them with their own Program clone (Program.Eval
+// reuses a scratch stack, so it isn't safe to share across goroutines), and
+// write directly into their slice of the grid. Output is still emitted
+// sequentially by the caller, so the SVG itself is unaffected.
+func computeGrid(prog *Program, p *params) [][][2]float64 {
+	n := p.cells + 1
+	grid := make([][][2]float64, n)
+	for i := range grid {
+		grid[i] = make([][2]float64, n)
+	}
+
+	rows := make(chan int, n)
+	for i := 0; i < n; i++ {
+		rows <- i
+	}
+	close(rows)
+
+	var wg sync.WaitGroup
+	workers := numWorkers(p)
+	wg.Add(workers)
+	for k := 0; k < workers; k++ {
+		go func() {
+			defer wg.Done()
+			worker := prog.Clone()
+			for i := range rows {
+				for j := 0; j < n; j++ {
+					x, y := corner(worker, i, j, p)
+					grid[i][j] = [2]float64{x, y}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return grid
+}
+
+// numWorkers returns the worker count to use for grid computation, capped
+// by p.workers (set from the -j flag or workers= query param) and falling
+// back to runtime.NumCPU() when unset.
+func numWorkers(p *params) int {
+	if p.workers > 0 {
+		return p.workers
+	}
+	if n := runtime.NumCPU(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// writeDomainColoring renders prog over [-xyrange,xyrange]² using the
+// standard domain-coloring scheme: arg(f(z)) selects hue and |f(z)| selects
+// lightness through a periodic function, so contours of constant modulus
+// appear as rings. This is the canonical way to spot poles, zeros and
+// branch cuts.
+func writeDomainColoring(w io.Writer, p *params, prog *Program) {
+	fmt.Fprintf(w, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"width='%d' height='%d' shape-rendering='crispEdges'>", p.width, p.height)
+	cw := float64(p.width) / float64(p.cells)
+	ch := float64(p.height) / float64(p.cells)
+	for i := 0; i < p.cells; i++ {
+		x := p.xyrange * (2*float64(i)/float64(p.cells) - 1)
+		for j := 0; j < p.cells; j++ {
+			y := p.xyrange * (2*float64(j)/float64(p.cells) - 1)
+			fz := prog.Eval(complex(x, y))
+			r, g, b := domainColor(fz)
+			px := float64(i) * cw
+			py := float64(p.height) - float64(j+1)*ch
+			fmt.Fprintf(w, "<rect x='%g' y='%g' width='%g' height='%g' fill='rgb(%d,%d,%d)' stroke='none'/>\n",
+				px, py, cw, ch, r, g, b)
+		}
+	}
+	fmt.Fprintln(w, "</svg>")
+}
+
+// domainColor maps f(z) to the fill color used by the domain-coloring
+// renderers: arg(f(z)) selects hue and |f(z)| selects lightness through a
+// periodic function of log2|f(z)|, so contours of constant modulus appear as
+// rings. |f(z)| of exactly 0 or +Inf (an exact zero or pole) would otherwise
+// send log2 to ±Inf and frac to NaN, so those are special-cased to pure
+// black and pure white respectively.
+func domainColor(fz complex128) (r, g, b int) {
+	hue := cmplx.Phase(fz) * 180 / math.Pi // (-180, 180]
+	if hue < 0 {
+		hue += 360
+	}
+	abs := cmplx.Abs(fz)
+	var lightness float64
+	switch {
+	case abs == 0:
+		lightness = 0
+	case math.IsInf(abs, 1):
+		lightness = 1
+	default:
+		lightness = 0.5 + 0.5*frac(math.Log2(abs))
+	}
+	if onGridLine(hue, lightness) {
+		lightness *= 0.6
+	}
+	return hslToRGB(hue, 1, lightness)
+}
+
+// onGridLine reports whether (hue, lightness) falls on one of the overlay
+// grid lines: every 30° of argument, or every integer power-of-two modulus.
+func onGridLine(hue, lightness float64) bool {
+	const eps = 0.015
+	argFrac := frac(hue / 30)
+	modFrac := frac((lightness - 0.5) / 0.5)
+	return argFrac < eps || argFrac > 1-eps || modFrac < eps || modFrac > 1-eps
+}
+
+// frac returns the fractional part of x, in [0,1).
+func frac(x float64) float64 {
+	return x - math.Floor(x)
+}
+
+// hslToRGB converts a color from HSL (hue in degrees, saturation and
+// lightness in [0,1]) to 8-bit RGB.
+func hslToRGB(h, s, l float64) (r, g, b int) {
+	c := (1 - math.Abs(2*l-1)) * s
+	hp := h / 60
+	x := c * (1 - math.Abs(math.Mod(hp, 2)-1))
+	var r1, g1, b1 float64
+	switch {
+	case hp < 1:
+		r1, g1, b1 = c, x, 0
+	case hp < 2:
+		r1, g1, b1 = x, c, 0
+	case hp < 3:
+		r1, g1, b1 = 0, c, x
+	case hp < 4:
+		r1, g1, b1 = 0, x, c
+	case hp < 5:
+		r1, g1, b1 = x, 0, c
+	default:
+		r1, g1, b1 = c, 0, x
+	}
+	m := l - c/2
+	return int(math.Round((r1 + m) * 255)), int(math.Round((g1 + m) * 255)), int(math.Round((b1 + m) * 255))
+}
+
+// sphereCameraDist is the camera's distance from the origin, in units of
+// the unit sphere's radius, used by the perspective projection in
+// writeSphere.
+const sphereCameraDist = 3.0
+
+// stereographic maps z=x+iy to its image on the unit Riemann sphere via
+// stereographic projection from the north pole: the plane becomes the
+// sphere with z=0 at the south pole and z=∞ at the north pole.
+func stereographic(x, y float64) (X, Y, Z float64) {
+	d := 1 + x*x + y*y
+	return 2 * x / d, 2 * y / d, (x*x + y*y - 1) / d
+}
+
+// rotate applies the camera orientation (elev, azim, both radians) to a
+// point on the sphere: first a rotation about the Y axis by azim, then
+// about the (new) X axis by elev.
+func rotate(X, Y, Z, elev, azim float64) (float64, float64, float64) {
+	cosA, sinA := math.Cos(azim), math.Sin(azim)
+	x1 := X*cosA + Z*sinA
+	z1 := -X*sinA + Z*cosA
+	cosE, sinE := math.Cos(elev), math.Sin(elev)
+	y2 := Y*cosE - z1*sinE
+	z2 := Y*sinE + z1*cosE
+	return x1, y2, z2
+}
+
+// project perspective-divides a rotated sphere point onto the 2D SVG
+// canvas, with the camera at sphereCameraDist looking at the origin along Z.
+func project(X, Y, Z float64, p *params) (float64, float64) {
+	persp := sphereCameraDist / (sphereCameraDist - Z)
+	scale := float64(p.height) * p.scaleFactor
+	sx := float64(p.width)/2 + X*persp*scale
+	sy := float64(p.height)/2 - Y*persp*scale
+	return sx, sy
+}
+
+// sphereColor maps f(z) to the fill color used by the sphere renderers:
+// arg(f(z)) selects hue and |f(z)| selects saturation via 1-1/(1+|f(z)|),
+// so poles saturate toward the north pole and zeros fade toward the south
+// pole. Unlike domainColor, there's no log here, so |f(z)| of 0 or +Inf
+// can't produce a NaN.
+func sphereColor(fz complex128) (r, g, b int) {
+	hue := cmplx.Phase(fz) * 180 / math.Pi
+	if hue < 0 {
+		hue += 360
+	}
+	sat := 1 - 1/(1+cmplx.Abs(fz))
+	return hslToRGB(hue, sat, 0.5)
+}
+
+// sphereQuad is one rendered cell of the Riemann sphere: its four projected
+// screen corners, the fill color from f at the cell center, and the mean
+// rotated Z used to depth-sort for the painter's algorithm.
+type sphereQuad struct {
+	corners [4][2]float64
+	meanZ   float64
+	fill    string
+}
+
+// writeSphere renders prog on the Riemann sphere: z=x+iy is mapped to its
+// stereographic image, rotated by the -elev/-azim camera angles and
+// perspective-projected to 2D. Cells are colored by arg f(z) (hue) and
+// |f(z)| (saturation, via 1-1/(1+|f|), so poles saturate toward the north
+// pole and zeros fade toward the south pole) and drawn back-to-front so
+// the far side of the sphere is correctly occluded.
+func writeSphere(w io.Writer, p *params, prog *Program) {
+	fmt.Fprintf(w, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"width='%d' height='%d'>", p.width, p.height)
+
+	quads := make([]sphereQuad, 0, p.cells*p.cells)
+	sphereCorner := func(i, j int) (X, Y, Z float64) {
+		x := p.xyrange * (2*float64(i)/float64(p.cells) - 1)
+		y := p.xyrange * (2*float64(j)/float64(p.cells) - 1)
+		X, Y, Z = stereographic(x, y)
+		return rotate(X, Y, Z, p.elev, p.azim)
+	}
+	for i := 0; i < p.cells; i++ {
+		cx := p.xyrange * (2*(float64(i)+0.5)/float64(p.cells) - 1)
+		for j := 0; j < p.cells; j++ {
+			cy := p.xyrange * (2*(float64(j)+0.5)/float64(p.cells) - 1)
+
+			var q sphereQuad
+			for k, ij := range [4][2]int{{i, j}, {i + 1, j}, {i + 1, j + 1}, {i, j + 1}} {
+				X, Y, Z := sphereCorner(ij[0], ij[1])
+				sx, sy := project(X, Y, Z, p)
+				q.corners[k] = [2]float64{sx, sy}
+				q.meanZ += Z
+			}
+			q.meanZ /= 4
+
+			fz := prog.Eval(complex(cx, cy))
+			r, g, b := sphereColor(fz)
+			q.fill = fmt.Sprintf("rgb(%d,%d,%d)", r, g, b)
+
+			quads = append(quads, q)
+		}
+	}
+
+	sort.Slice(quads, func(a, b int) bool { return quads[a].meanZ < quads[b].meanZ })
+	for _, q := range quads {
+		fmt.Fprintf(w, "<polygon points='%g,%g %g,%g %g,%g %g,%g' fill='%s' stroke='none'/>\n",
+			q.corners[0][0], q.corners[0][1], q.corners[1][0], q.corners[1][1],
+			q.corners[2][0], q.corners[2][1], q.corners[3][0], q.corners[3][1], q.fill)
+	}
+	fmt.Fprintln(w, "</svg>")
+}
+
+type Expr interface {
 	Eval(env Env) complex128
 	Check(vars map[Var]bool) error
 }
@@ -173,30 +677,30 @@ type literal complex128
 
 type unary struct {
 	op rune
-	z Expr
+	z  Expr
 }
 
 type binary struct {
-	op rune
-	z,w Expr
+	op   rune
+	z, w Expr
 }
 
-type call struct{
-	fn string
+type call struct {
+	fn   string
 	args []Expr
 }
 
 type Env map[Var]complex128
 
-func (v Var) Eval(env Env) complex128{
+func (v Var) Eval(env Env) complex128 {
 	return env[v]
 }
 
-func (l literal) Eval(_ Env) complex128{
+func (l literal) Eval(_ Env) complex128 {
 	return complex128(l)
 }
 
-func (u unary) Eval(env Env) complex128{
+func (u unary) Eval(env Env) complex128 {
 	switch u.op {
 	case '+':
 		return +u.z.Eval(env)
@@ -206,7 +710,7 @@ func (u unary) Eval(env Env) complex128{
 	panic(fmt.Sprintf("unsupported unary operator: %q", u.op))
 }
 
-func (b binary) Eval(env Env) complex128{
+func (b binary) Eval(env Env) complex128 {
 	switch b.op {
 	case '+':
 		return b.z.Eval(env) + b.w.Eval(env)
@@ -216,24 +720,56 @@ func (b binary) Eval(env Env) complex128{
 		return b.z.Eval(env) * b.w.Eval(env)
 	case '/':
 		return b.z.Eval(env) / b.w.Eval(env)
+	case '^':
+		return cmplx.Pow(b.z.Eval(env), b.w.Eval(env))
 	}
 	panic(fmt.Sprintf("unsupported binary operator: %q", b.op))
 }
 
-func (c call) Eval(env Env) complex128{
-	switch c.fn{
+func (c call) Eval(env Env) complex128 {
+	switch c.fn {
 	case "pow":
 		return cmplx.Pow(c.args[0].Eval(env), c.args[1].Eval(env))
 	case "sin":
 		return cmplx.Sin(c.args[0].Eval(env))
 	case "cos":
 		return cmplx.Cos(c.args[0].Eval(env))
+	case "tan":
+		return cmplx.Tan(c.args[0].Eval(env))
+	case "asin":
+		return cmplx.Asin(c.args[0].Eval(env))
+	case "acos":
+		return cmplx.Acos(c.args[0].Eval(env))
+	case "atan":
+		return cmplx.Atan(c.args[0].Eval(env))
+	case "sinh":
+		return cmplx.Sinh(c.args[0].Eval(env))
+	case "cosh":
+		return cmplx.Cosh(c.args[0].Eval(env))
+	case "tanh":
+		return cmplx.Tanh(c.args[0].Eval(env))
 	case "sqrt":
 		return cmplx.Sqrt(c.args[0].Eval(env))
 	case "exp":
 		return cmplx.Exp(c.args[0].Eval(env))
 	case "Log":
 		return cmplx.Log(c.args[0].Eval(env))
+	case "log":
+		return cmplx.Log(c.args[0].Eval(env))
+	case "log10":
+		return cmplx.Log(c.args[0].Eval(env)) / complex(math.Log(10), 0)
+	case "abs":
+		return complex(cmplx.Abs(c.args[0].Eval(env)), 0)
+	case "re":
+		return complex(real(c.args[0].Eval(env)), 0)
+	case "im":
+		return complex(imag(c.args[0].Eval(env)), 0)
+	case "conj":
+		return cmplx.Conj(c.args[0].Eval(env))
+	case "arg":
+		return complex(cmplx.Phase(c.args[0].Eval(env)), 0)
+	case "polar":
+		return cmplx.Rect(real(c.args[0].Eval(env)), real(c.args[1].Eval(env)))
 	}
 	panic(fmt.Sprintf("unsupported function call: %q", c.fn))
 }
@@ -247,58 +783,288 @@ func (literal) Check(vars map[Var]bool) error {
 	return nil
 }
 
-func (u unary) Check(vars map[Var]bool) error{
-	if !strings.ContainsRune("+-", u.op){
+func (u unary) Check(vars map[Var]bool) error {
+	if !strings.ContainsRune("+-", u.op) {
 		return fmt.Errorf("unexpected unary op %q", u.op)
 	}
 	return u.z.Check(vars)
 }
 
 func (b binary) Check(vars map[Var]bool) error {
-	if !strings.ContainsRune("+-*/", b.op){
+	if !strings.ContainsRune("+-*/^", b.op) {
 		return fmt.Errorf("unexpected binary op %q", b.op)
 	}
-	if err := b.z.Check(vars); err != nil{
+	if err := b.z.Check(vars); err != nil {
 		return err
 	}
 	return b.w.Check(vars)
 }
 
-var numParams = map[string]int{"pow":2,"sin":1,"sqrt":1,"exp":1,"Log":1}
+var numParams = map[string]int{
+	"pow": 2, "sin": 1, "cos": 1, "tan": 1, "asin": 1, "acos": 1, "atan": 1,
+	"sinh": 1, "cosh": 1, "tanh": 1, "sqrt": 1, "exp": 1, "Log": 1, "log": 1,
+	"log10": 1, "abs": 1, "re": 1, "im": 1, "conj": 1, "arg": 1, "polar": 2,
+}
 
-func (c call) Check(vars map[Var]bool) error{
+func (c call) Check(vars map[Var]bool) error {
 	arity, ok := numParams[c.fn]
 	if !ok {
 		return fmt.Errorf("unkown function %q", c.fn)
 	}
-	if len(c.args) != arity{
+	if len(c.args) != arity {
 		return fmt.Errorf("call to %q has %d args, want %d", c.fn, len(c.args), arity)
 	}
 	for _, arg := range c.args {
-		if err := arg.Check(vars); err != nil{
+		if err := arg.Check(vars); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func parseAndCheck(s string) (Expr, error){
-	if s == ""{
+// opcode is a single bytecode instruction for the Program VM.
+type opcode int
+
+const (
+	opLoadZ opcode = iota
+	opLoadT
+	opConst
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opNeg
+	opPow
+	opCall
+)
+
+// instruction is one step of a compiled Program: an opcode plus an index
+// into consts (for opConst) or fnTable (for opCall).
+type instruction struct {
+	op  opcode
+	arg int
+}
+
+// Program is a flattened, allocation-free form of an Expr tree: a sequence
+// of instructions operating on a complex128 stack, plus the constant pool
+// they reference. Compile produces a Program once; Eval can then be called
+// repeatedly without walking the AST or allocating an Env.
+type Program struct {
+	code   []instruction
+	consts []complex128
+	stack  []complex128 // scratch space, sized once and reused across Eval calls
+	t      complex128   // value bound to the animation variable t, see WithT
+}
+
+// fnSpec describes one callable function for the bytecode interpreter: its
+// arity and how to apply it to that many popped stack values.
+type fnSpec struct {
+	arity int
+	apply func(args []complex128) complex128
+}
+
+// fnTable mirrors the functions supported by call.Eval, indexed by the ids
+// in fnIDs.
+var fnTable = []fnSpec{
+	{2, func(a []complex128) complex128 { return cmplx.Pow(a[0], a[1]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Sin(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Cos(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Tan(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Asin(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Acos(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Atan(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Sinh(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Cosh(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Tanh(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Sqrt(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Exp(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Log(a[0]) }},
+	{1, func(a []complex128) complex128 { return cmplx.Log(a[0]) / complex(math.Log(10), 0) }},
+	{1, func(a []complex128) complex128 { return complex(cmplx.Abs(a[0]), 0) }},
+	{1, func(a []complex128) complex128 { return complex(real(a[0]), 0) }},
+	{1, func(a []complex128) complex128 { return complex(imag(a[0]), 0) }},
+	{1, func(a []complex128) complex128 { return cmplx.Conj(a[0]) }},
+	{1, func(a []complex128) complex128 { return complex(cmplx.Phase(a[0]), 0) }},
+	{2, func(a []complex128) complex128 { return cmplx.Rect(real(a[0]), real(a[1])) }},
+}
+
+// fnIDs maps a call's function name to its index into fnTable.
+var fnIDs = map[string]int{
+	"pow": 0, "sin": 1, "cos": 2, "tan": 3, "asin": 4, "acos": 5, "atan": 6,
+	"sinh": 7, "cosh": 8, "tanh": 9, "sqrt": 10, "exp": 11, "Log": 12, "log": 12,
+	"log10": 13, "abs": 14, "re": 15, "im": 16, "conj": 17, "arg": 18, "polar": 19,
+}
+
+// Compile lowers an Expr tree, as produced by Parse, into a Program. The
+// tree is walked once; the per-cell inner loop in writesvg and
+// writeDomainColoring then runs Program.Eval, which avoids allocating an
+// Env and dispatching through the Expr interface on every call.
+func Compile(e Expr) *Program {
+	c := &compiler{}
+	c.compile(e)
+	depth := c.maxDepth
+	return &Program{code: c.code, consts: c.consts, stack: make([]complex128, depth)}
+}
+
+// Clone returns a Program sharing the same code and constant pool but with
+// its own scratch stack, so it can be evaluated concurrently with the
+// original and with other clones.
+func (p *Program) Clone() *Program {
+	return &Program{code: p.code, consts: p.consts, stack: make([]complex128, len(p.stack)), t: p.t}
+}
+
+// WithT returns a clone of the program with its animation variable t bound
+// to the given value, for rendering one frame of an expression that
+// references t (see writeAnimatedSVG).
+func (p *Program) WithT(t complex128) *Program {
+	clone := p.Clone()
+	clone.t = t
+	return clone
+}
+
+// compiler accumulates the instructions and constant pool for a single
+// Compile call, tracking the deepest the stack grows so Program.stack can
+// be sized once up front.
+type compiler struct {
+	code     []instruction
+	consts   []complex128
+	depth    int
+	maxDepth int
+}
+
+func (c *compiler) emit(op opcode, arg int) {
+	c.code = append(c.code, instruction{op, arg})
+}
+
+func (c *compiler) push() {
+	c.depth++
+	if c.depth > c.maxDepth {
+		c.maxDepth = c.depth
+	}
+}
+
+func (c *compiler) compile(e Expr) {
+	switch e := e.(type) {
+	case Var:
+		switch e {
+		case "z":
+			c.emit(opLoadZ, 0)
+		case "t":
+			c.emit(opLoadT, 0)
+		default:
+			panic(fmt.Sprintf("compile: unsupported variable %q", e))
+		}
+		c.push()
+
+	case literal:
+		idx := len(c.consts)
+		c.consts = append(c.consts, complex128(e))
+		c.emit(opConst, idx)
+		c.push()
+
+	case unary:
+		c.compile(e.z)
+		if e.op == '-' {
+			c.emit(opNeg, 0)
+		}
+
+	case binary:
+		c.compile(e.z)
+		c.compile(e.w)
+		var op opcode
+		switch e.op {
+		case '+':
+			op = opAdd
+		case '-':
+			op = opSub
+		case '*':
+			op = opMul
+		case '/':
+			op = opDiv
+		case '^':
+			op = opPow
+		default:
+			panic(fmt.Sprintf("compile: unsupported binary operator %q", e.op))
+		}
+		c.emit(op, 0)
+		c.depth-- // binary ops pop two values and push one
+
+	case call:
+		for _, arg := range e.args {
+			c.compile(arg)
+		}
+		id, ok := fnIDs[e.fn]
+		if !ok {
+			panic(fmt.Sprintf("compile: unsupported function call: %q", e.fn))
+		}
+		c.emit(opCall, id)
+		c.depth -= fnTable[id].arity - 1 // a call pops its args and pushes one result
+
+	default:
+		panic(fmt.Sprintf("compile: unsupported expr type %T", e))
+	}
+}
+
+// Eval runs the program for a given z (t defaults to 0, or whatever WithT
+// last bound it to), reusing p.stack so no allocation happens on the hot
+// path.
+func (p *Program) Eval(z complex128) complex128 {
+	stack := p.stack
+	sp := 0
+	for _, ins := range p.code {
+		switch ins.op {
+		case opLoadZ:
+			stack[sp] = z
+			sp++
+		case opLoadT:
+			stack[sp] = p.t
+			sp++
+		case opConst:
+			stack[sp] = p.consts[ins.arg]
+			sp++
+		case opAdd:
+			stack[sp-2] += stack[sp-1]
+			sp--
+		case opSub:
+			stack[sp-2] -= stack[sp-1]
+			sp--
+		case opMul:
+			stack[sp-2] *= stack[sp-1]
+			sp--
+		case opDiv:
+			stack[sp-2] /= stack[sp-1]
+			sp--
+		case opNeg:
+			stack[sp-1] = -stack[sp-1]
+		case opPow:
+			stack[sp-2] = cmplx.Pow(stack[sp-2], stack[sp-1])
+			sp--
+		case opCall:
+			fn := fnTable[ins.arg]
+			sp -= fn.arity
+			stack[sp] = fn.apply(stack[sp : sp+fn.arity])
+			sp++
+		}
+	}
+	return stack[0]
+}
+
+func parseAndCheck(s string) (Expr, error) {
+	if s == "" {
 		return nil, fmt.Errorf("empty expression")
 	}
 	expr, err := Parse(s)
-	if err != nil{
+	if err != nil {
 		return nil, err
 	}
 	vars := make(map[Var]bool)
-	if err := expr.Check(vars); err != nil{
+	if err := expr.Check(vars); err != nil {
 		return nil, err
 	}
-	if len(vars) > 1 {
-		return nil, fmt.Errorf("too many variables")
-	}
+	// z is the point being evaluated; t is the optional animation variable
+	// bound per frame by the /animate handler (see writeAnimatedSVG).
 	for v := range vars {
-		if v != "z"{
+		if v != "z" && v != "t" {
 			return nil, fmt.Errorf("undefined variable: %s", v)
 		}
 	}
@@ -380,7 +1146,31 @@ func parseUnary(lex *lexer) Expr {
 		lex.next() // consume '+' or '-'
 		return unary{op, parseUnary(lex)}
 	}
-	return parsePrimary(lex)
+	return parsePow(lex)
+}
+
+// parsePow parses a primary, optionally followed by '^' and a unary
+// expression. '^' binds tighter than unary +/- on its left (so "-z^2" is
+// "-(z^2)") but accepts a signed exponent on its right (so "z^-1" parses),
+// and is right-associative (so "z^2^3" is "z^(2^3)" and "z^-2^3" is
+// "z^(-(2^3))"), so it is handled outside the left-associative climbing in
+// parseBinary.
+func parsePow(lex *lexer) Expr {
+	lhs := parsePrimary(lex)
+	if lex.token == '^' {
+		lex.next() // consume '^'
+		rhs := parseUnary(lex)
+		return binary{'^', lhs, rhs}
+	}
+	return lhs
+}
+
+// constants holds the named complex constants available to expressions.
+var constants = map[string]complex128{
+	"i":   complex(0, 1),
+	"pi":  complex(math.Pi, 0),
+	"e":   complex(math.E, 0),
+	"inf": complex(math.Inf(1), 0),
 }
 
 func parsePrimary(lex *lexer) Expr {
@@ -389,6 +1179,9 @@ func parsePrimary(lex *lexer) Expr {
 		id := lex.text()
 		lex.next()
 		if lex.token != '(' {
+			if v, ok := constants[id]; ok {
+				return literal(v)
+			}
 			return Var(id)
 		}
 		lex.next()
@@ -429,4 +1222,4 @@ func parsePrimary(lex *lexer) Expr {
 	}
 	msg := fmt.Sprintf("unexpected %s", lex.describe())
 	panic(lexPanic(msg))
-}
\ No newline at end of file
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/cmplx"
+	"net/url"
+	"runtime"
+	"testing"
+)
+
+// TestCompileMatchesEval checks that Program.Eval agrees with the AST
+// interpreter across a grid of sample points.
+func TestCompileMatchesEval(t *testing.T) {
+	expr, err := parseAndCheck("sin(z)/(1+z*z)")
+	if err != nil {
+		t.Fatalf("parseAndCheck: %v", err)
+	}
+	prog := Compile(expr)
+	for x := -2.0; x <= 2.0; x += 0.5 {
+		for y := -2.0; y <= 2.0; y += 0.5 {
+			z := complex(x, y)
+			want := expr.Eval(Env{"z": z})
+			got := prog.Eval(z)
+			if cmplx.Abs(got-want) > 1e-9 {
+				t.Errorf("Program.Eval(%v) = %v, want %v", z, got, want)
+			}
+		}
+	}
+}
+
+// TestParsePowPrecedence checks that '^' binds tighter than unary minus and
+// is right-associative.
+func TestParsePowPrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		z    complex128
+		want complex128
+	}{
+		{"-z^2", 3, -cmplx.Pow(3, 2)},               // -(z^2), not (-z)^2
+		{"z^2^3", 2, cmplx.Pow(2, cmplx.Pow(2, 3))}, // z^(2^3), not (z^2)^3
+		{"z^-1", 2, cmplx.Pow(2, -1)},               // a signed exponent must parse
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", test.expr, err)
+		}
+		got := expr.Eval(Env{"z": test.z})
+		if cmplx.Abs(got-test.want) > 1e-9 {
+			t.Errorf("Eval(%q) with z=%v = %v, want %v", test.expr, test.z, got, test.want)
+		}
+	}
+}
+
+// TestConstants checks that named constants are resolved without requiring
+// them to be bound in Env.
+func TestConstants(t *testing.T) {
+	tests := []struct {
+		expr string
+		want complex128
+	}{
+		{"i", complex(0, 1)},
+		{"i*i", -1},
+		{"e", complex(2.718281828459045, 0)},
+	}
+	for _, test := range tests {
+		expr, err := parseAndCheck(test.expr)
+		if err != nil {
+			t.Fatalf("parseAndCheck(%q): %v", test.expr, err)
+		}
+		got := expr.Eval(Env{})
+		if cmplx.Abs(got-test.want) > 1e-9 {
+			t.Errorf("Eval(%q) = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+// TestDomainColorZeroPole checks that domainColor produces a valid RGB
+// triple (no NaN-derived garbage) at an exact zero and an exact pole of
+// f(z), the two cases where log2|f(z)| is infinite.
+func TestDomainColorZeroPole(t *testing.T) {
+	tests := []struct {
+		name string
+		fz   complex128
+	}{
+		{"zero", 0},
+		{"pole", complex(math.Inf(1), 0)},
+	}
+	for _, test := range tests {
+		r, g, b := domainColor(test.fz)
+		for _, c := range []int{r, g, b} {
+			if c < 0 || c > 255 {
+				t.Errorf("domainColor(%v) at %s = (%d,%d,%d), component out of [0,255]", test.fz, test.name, r, g, b)
+			}
+		}
+	}
+}
+
+// TestOnGridLine checks the grid-line overlay predicate at argument and
+// modulus values exactly on and clearly off the 30°/power-of-two lines.
+func TestOnGridLine(t *testing.T) {
+	tests := []struct {
+		hue, lightness float64
+		want           bool
+	}{
+		{0, 0.75, true},   // arg = 0°
+		{30, 0.75, true},  // arg = 30°
+		{15, 0.75, false}, // halfway between both kinds of grid line
+		{15, 1.0, true},   // modulus = 2^1, on a ring
+		{15, 0.6, false},  // off both the argument and modulus lines
+	}
+	for _, test := range tests {
+		got := onGridLine(test.hue, test.lightness)
+		if got != test.want {
+			t.Errorf("onGridLine(%g, %g) = %v, want %v", test.hue, test.lightness, got, test.want)
+		}
+	}
+}
+
+// TestHSLToRGB checks hslToRGB against known HSL->RGB conversions at the
+// primary and secondary hues, plus the achromatic (zero-saturation) case.
+func TestHSLToRGB(t *testing.T) {
+	tests := []struct {
+		h, s, l float64
+		r, g, b int
+	}{
+		{0, 1, 0.5, 255, 0, 0},     // red
+		{120, 1, 0.5, 0, 255, 0},   // green
+		{240, 1, 0.5, 0, 0, 255},   // blue
+		{0, 0, 0.5, 128, 128, 128}, // achromatic gray
+		{0, 1, 0, 0, 0, 0},         // black
+		{0, 1, 1, 255, 255, 255},   // white
+	}
+	for _, test := range tests {
+		r, g, b := hslToRGB(test.h, test.s, test.l)
+		if r != test.r || g != test.g || b != test.b {
+			t.Errorf("hslToRGB(%g, %g, %g) = (%d,%d,%d), want (%d,%d,%d)",
+				test.h, test.s, test.l, r, g, b, test.r, test.g, test.b)
+		}
+	}
+}
+
+// TestComputeGridWorkerCountIndependent checks that computeGrid's output
+// doesn't depend on how many workers split the rows across goroutines,
+// guarding against an off-by-one in row ownership that would silently
+// corrupt a subset of the grid. Run with -race to also catch any data race
+// in the shared grid slice.
+func TestComputeGridWorkerCountIndependent(t *testing.T) {
+	p, prog := benchWritesvgParams(1)
+	p.cells = 40
+	want := computeGrid(prog, p)
+
+	for _, workers := range []int{2, 3, 7} {
+		p, prog := benchWritesvgParams(workers)
+		p.cells = 40
+		got := computeGrid(prog, p)
+		for i := range want {
+			for j := range want[i] {
+				if got[i][j] != want[i][j] {
+					t.Fatalf("workers=%d: grid[%d][%d] = %v, want %v", workers, i, j, got[i][j], want[i][j])
+				}
+			}
+		}
+	}
+}
+
+// TestParamsFromQueryCapsWorkers checks that the workers= query parameter
+// is clamped, so a single request can't make computeGrid spawn an
+// unbounded number of goroutines.
+func TestParamsFromQueryCapsWorkers(t *testing.T) {
+	q := url.Values{"workers": {"100000000"}}
+	p := paramsFromQuery(params{}, q)
+	if p.workers != maxQueryWorkers {
+		t.Errorf("paramsFromQuery with workers=1e8 set p.workers = %d, want %d", p.workers, maxQueryWorkers)
+	}
+}
+
+// TestStereographic checks the projection from the plane to the unit
+// Riemann sphere at the south pole (z=0), a point on the equator, and
+// toward the north pole as |z|->∞.
+func TestStereographic(t *testing.T) {
+	tests := []struct {
+		name    string
+		x, y    float64
+		X, Y, Z float64
+	}{
+		{"south pole", 0, 0, 0, 0, -1},
+		{"equator", 1, 0, 1, 0, 0},
+	}
+	for _, test := range tests {
+		X, Y, Z := stereographic(test.x, test.y)
+		if math.Abs(X-test.X) > 1e-9 || math.Abs(Y-test.Y) > 1e-9 || math.Abs(Z-test.Z) > 1e-9 {
+			t.Errorf("stereographic(%g, %g) at %s = (%g,%g,%g), want (%g,%g,%g)",
+				test.x, test.y, test.name, X, Y, Z, test.X, test.Y, test.Z)
+		}
+	}
+	// Points far from the origin approach the north pole (Z -> 1).
+	if _, _, Z := stereographic(1e6, 0); Z < 0.999999 {
+		t.Errorf("stereographic(1e6, 0) Z = %g, want close to 1", Z)
+	}
+	// stereographic always maps onto the unit sphere.
+	X, Y, Z := stereographic(0.7, -1.3)
+	if r := X*X + Y*Y + Z*Z; math.Abs(r-1) > 1e-9 {
+		t.Errorf("stereographic(0.7, -1.3) has |X,Y,Z|^2 = %g, want 1", r)
+	}
+}
+
+// TestRotate checks the camera rotation at zero angles (identity) and at a
+// quarter turn about each axis.
+func TestRotate(t *testing.T) {
+	if X, Y, Z := rotate(1, 2, 3, 0, 0); X != 1 || Y != 2 || Z != 3 {
+		t.Errorf("rotate(1, 2, 3, 0, 0) = (%g,%g,%g), want (1,2,3)", X, Y, Z)
+	}
+	// A quarter-turn azimuth about Y maps the +X axis onto -Z.
+	X, Y, Z := rotate(1, 0, 0, 0, math.Pi/2)
+	if math.Abs(X) > 1e-9 || math.Abs(Y) > 1e-9 || math.Abs(Z-(-1)) > 1e-9 {
+		t.Errorf("rotate(1, 0, 0, 0, pi/2) = (%g,%g,%g), want (0,0,-1)", X, Y, Z)
+	}
+	// A quarter-turn elevation about X maps the +Y axis onto +Z.
+	X, Y, Z = rotate(0, 1, 0, math.Pi/2, 0)
+	if math.Abs(X) > 1e-9 || math.Abs(Y) > 1e-9 || math.Abs(Z-1) > 1e-9 {
+		t.Errorf("rotate(0, 1, 0, pi/2, 0) = (%g,%g,%g), want (0,0,1)", X, Y, Z)
+	}
+}
+
+// TestFrameTimes checks the evenly-spaced t samples /animate renders,
+// including the single-frame case where there's no step to divide by.
+func TestFrameTimes(t *testing.T) {
+	ts := frameTimes(0, 1, 5)
+	want := []complex128{0, 0.25, 0.5, 0.75, 1}
+	for k, w := range want {
+		if cmplx.Abs(ts[k]-w) > 1e-9 {
+			t.Errorf("frameTimes(0, 1, 5)[%d] = %v, want %v", k, ts[k], w)
+		}
+	}
+	if single := frameTimes(2, 5, 1); single[0] != complex(2, 0) {
+		t.Errorf("frameTimes(2, 5, 1)[0] = %v, want %v", single[0], complex(2, 0))
+	}
+}
+
+// gridPoints returns the sample points a 500x500-cell render would evaluate,
+// used to compare AST-walking Eval against bytecode Program.Eval.
+func gridPoints() []complex128 {
+	const cells = 500
+	const xyrange = 30.0
+	points := make([]complex128, 0, cells*cells)
+	for i := 0; i < cells; i++ {
+		x := xyrange * (float64(i)/float64(cells) - 0.5)
+		for j := 0; j < cells; j++ {
+			y := xyrange * (float64(j)/float64(cells) - 0.5)
+			points = append(points, complex(x, y))
+		}
+	}
+	return points
+}
+
+func BenchmarkASTEval(b *testing.B) {
+	expr, err := parseAndCheck("sin(z)/(1+z*z)")
+	if err != nil {
+		b.Fatalf("parseAndCheck: %v", err)
+	}
+	points := gridPoints()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, z := range points {
+			expr.Eval(Env{"z": z})
+		}
+	}
+}
+
+func BenchmarkBytecodeEval(b *testing.B) {
+	expr, err := parseAndCheck("sin(z)/(1+z*z)")
+	if err != nil {
+		b.Fatalf("parseAndCheck: %v", err)
+	}
+	prog := Compile(expr)
+	points := gridPoints()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, z := range points {
+			prog.Eval(z)
+		}
+	}
+}
+
+// benchWritesvgParams builds the params for the writesvg worker-pool
+// benchmarks: 500 cells and an expression expensive enough to make the
+// evaluator, not the SVG encoding, the bottleneck.
+func benchWritesvgParams(workers int) (*params, *Program) {
+	p := params{
+		width: 600, height: 320, cells: 500,
+		xyrange: 30.0, scaleFactor: 0.4, angle: 2 * math.Pi / 12,
+	}
+	p.xyscale = float64(p.width) / 2.0 / p.xyrange
+	p.zscale = float64(p.height) * p.scaleFactor
+	p.workers = workers
+	expr, err := parseAndCheck("pow(sin(z), 3) + cos(z*z)")
+	if err != nil {
+		panic(err)
+	}
+	return &p, Compile(expr)
+}
+
+func BenchmarkWritesvgSingleWorker(b *testing.B) {
+	p, prog := benchWritesvgParams(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writesvg(io.Discard, p, prog)
+	}
+}
+
+func BenchmarkWritesvgAllWorkers(b *testing.B) {
+	p, prog := benchWritesvgParams(runtime.NumCPU())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writesvg(io.Discard, p, prog)
+	}
+}